@@ -5,9 +5,14 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/internal/blobinfocache"
 	"github.com/containers/image/v5/internal/image"
+	compressiontypes "github.com/containers/image/v5/pkg/compression/types"
 	"github.com/containers/image/v5/transports"
 	"github.com/containers/image/v5/types"
 	digest "github.com/opencontainers/go-digest"
@@ -15,9 +20,10 @@ import (
 )
 
 var (
-	_ types.ImageReference   = &BlobCache{}
-	_ types.ImageSource      = &blobCacheSource{}
-	_ types.ImageDestination = &blobCacheDestination{}
+	_ types.ImageReference         = &BlobCache{}
+	_ types.ImageSource            = &blobCacheSource{}
+	_ types.ImageDestination       = &blobCacheDestination{}
+	_ blobinfocache.BlobInfoCache2 = &BlobCache{}
 )
 
 const (
@@ -25,10 +31,89 @@ const (
 	decompressedNote = ".decompressed"
 )
 
+// noteDigest records, in a small file alongside the cached blobs, that primary's cached copy
+// is related to related's by the relationship named by note (one of compressedNote or
+// decompressedNote), so that a later lookup for one can find the other. A primary digest can
+// have more than one compressedNote relative (e.g. both a gzip and a zstd copy of the same
+// uncompressed content), so entries are appended and deduplicated rather than overwritten.
+func (b *BlobCache) noteDigest(primary digest.Digest, note string, related digest.Digest) {
+	filename := filepath.Join(b.directory, primary.String()+note)
+	for _, d := range b.readNotedDigests(primary, note) {
+		if d == related {
+			return
+		}
+	}
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, related.String())
+}
+
+// readNotedDigests is the inverse of noteDigest, returning every related digest recorded for
+// primary under note.
+func (b *BlobCache) readNotedDigests(primary digest.Digest, note string) []digest.Digest {
+	filename := filepath.Join(b.directory, primary.String()+note)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+	var digests []digest.Digest
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		if d, err := digest.Parse(line); err == nil {
+			digests = append(digests, d)
+		}
+	}
+	return digests
+}
+
+// compressionZstdChunked is the compression algorithm name reported for zstd:chunked blobs.
+const compressionZstdChunked = "zstd:chunked"
+
+// preferredSubstitute looks for a cached alternate representation of blobDigest (compressed if
+// we were given the uncompressed digest, or vice versa), honoring b.preferChunked and
+// b.compressionAlgorithms when more than one compressed variant is cached, and returns its
+// digest if one is cached locally.
+func (b *BlobCache) preferredSubstitute(blobDigest digest.Digest) (digest.Digest, bool) {
+	if compressed := b.readNotedDigests(blobDigest, compressedNote); len(compressed) > 0 {
+		best := compressed[0]
+		bestRank := b.compressionRank(b.compressorFor(best))
+		for _, d := range compressed[1:] {
+			if rank := b.compressionRank(b.compressorFor(d)); rank < bestRank {
+				best, bestRank = d, rank
+			}
+		}
+		return best, true
+	}
+	if uncompressed := b.readNotedDigests(blobDigest, decompressedNote); len(uncompressed) > 0 {
+		return uncompressed[0], true
+	}
+	return "", false
+}
+
+// compressorFor looks up the compression algorithm name previously recorded for digest via
+// RecordDigestCompressorData, or "" if none is known.
+func (b *BlobCache) compressorFor(blobDigest digest.Digest) string {
+	var compressor string
+	_ = b.withBlobInfoCache(func(index *blobCacheIndex) error {
+		compressor = index.DigestCompressors[blobDigest]
+		return nil
+	})
+	return compressor
+}
+
 // BlobCache is an object which saves copies of blobs that are written to it while passing them
 // through to some real destination, and which can be queried directly in order to read them
 // back.
 //
+// It also implements blobinfocache.BlobInfoCache2, backed by a small JSON index kept alongside
+// the cached blobs, so that a BlobCache's directory can be passed as the BlobInfoCache for a
+// copy operation in place of a separately-configured boltdb cache.
+//
 // Implements types.ImageReference.
 type BlobCache struct {
 	reference types.ImageReference
@@ -36,6 +121,43 @@ type BlobCache struct {
 	// both within this process and by multiple different processes
 	directory string
 	compress  types.LayerCompression
+
+	// compressionAlgorithms lists compressed forms in preference order; it only ranks cached
+	// substitutes and candidates (see compressionRank) and does not limit which forms are
+	// stored or offered. An empty list ranks all forms equally.
+	compressionAlgorithms []compressiontypes.Algorithm
+	// preferChunked, if true, ranks zstd:chunked substitutes ahead of every other form. No
+	// tar-split or chunk index sidecar is kept for them.
+	preferChunked bool
+
+	// maxBytes and maxAge bound the cache's size; see BlobCacheOptions.
+	maxBytes int64
+	maxAge   time.Duration
+
+	blobInfoCacheMutex sync.Mutex
+
+	accessMutex sync.Mutex
+	pinMutex    sync.Mutex
+	pinned      map[digest.Digest]int
+}
+
+// BlobCacheOptions augments NewBlobCache with a richer compression policy than a bare
+// types.LayerCompression value can express.
+type BlobCacheOptions struct {
+	// Compress has the same meaning as the compress argument to NewBlobCache.
+	Compress types.LayerCompression
+	// CompressionAlgorithms lists compressed forms in preference order, used to choose among
+	// cached compressed variants of a blob; it does not limit which forms are stored.
+	CompressionAlgorithms []compressiontypes.Algorithm
+	// PreferChunked prefers zstd:chunked substitutes over plain zstd or gzip when one is
+	// available locally. Chunk index sidecars are not stored.
+	PreferChunked bool
+	// MaxBytes, if positive, bounds the total size of blobs (configs excluded) kept in the
+	// cache directory; PutBlob evicts the least-recently-used blobs to stay under it.
+	MaxBytes int64
+	// MaxAge, if positive, evicts blobs that haven't been read or written in longer than
+	// this, regardless of MaxBytes.
+	MaxAge time.Duration
 }
 
 func makeFilename(blobSum digest.Digest, isConfig bool) string {
@@ -51,19 +173,33 @@ func makeFilename(blobSum digest.Digest, isConfig bool) string {
 // The compress argument controls whether or not the cache will try to substitute a compressed
 // or different version of a blob when preparing the list of layers when reading an image.
 func NewBlobCache(ref types.ImageReference, directory string, compress types.LayerCompression) (*BlobCache, error) {
+	return NewBlobCacheWithOptions(ref, directory, BlobCacheOptions{Compress: compress})
+}
+
+// NewBlobCacheWithOptions creates a new blob cache that wraps an image reference, the same way
+// NewBlobCache does, but additionally accepts a compression policy richer than a bare
+// types.LayerCompression can express: a preference-ordered list of compression algorithms
+// (for example gzip, zstd, and zstd:chunked) that decides which cached compressed variant is
+// offered first as a substitute for a requested blob.
+func NewBlobCacheWithOptions(ref types.ImageReference, directory string, options BlobCacheOptions) (*BlobCache, error) {
 	if directory == "" {
 		return nil, fmt.Errorf("error creating cache around reference %q: no directory specified", transports.ImageName(ref))
 	}
-	switch compress {
+	switch options.Compress {
 	case types.Compress, types.Decompress, types.PreserveOriginal:
 		// valid value, accept it
 	default:
-		return nil, fmt.Errorf("unhandled LayerCompression value %v", compress)
+		return nil, fmt.Errorf("unhandled LayerCompression value %v", options.Compress)
 	}
 	return &BlobCache{
-		reference: ref,
-		directory: directory,
-		compress:  compress,
+		reference:             ref,
+		directory:             directory,
+		compress:              options.Compress,
+		compressionAlgorithms: options.CompressionAlgorithms,
+		preferChunked:         options.PreferChunked,
+		maxBytes:              options.MaxBytes,
+		maxAge:                options.MaxAge,
+		pinned:                make(map[digest.Digest]int),
 	}, nil
 }
 
@@ -114,6 +250,9 @@ func (b *BlobCache) Directory() string {
 	return b.directory
 }
 
+// ClearCache removes every blob and metadata file from the cache directory.  Entries that
+// another process is actively writing (held under a lock acquired by newCacheFileWriter) are
+// left in place rather than removed out from under that writer.
 func (b *BlobCache) ClearCache() error {
 	f, err := os.Open(b.directory)
 	if err != nil {
@@ -125,8 +264,21 @@ func (b *BlobCache) ClearCache() error {
 		return perrors.Wrapf(err, "error reading directory %q", b.directory)
 	}
 	for _, name := range names {
+		if isTempCacheFile(name) {
+			continue
+		}
 		pathname := filepath.Join(b.directory, name)
-		if err = os.RemoveAll(pathname); err != nil {
+		lock, locked, err := tryLockPath(pathname)
+		if err != nil {
+			return perrors.Wrapf(err, "locking %q", pathname)
+		}
+		if !locked {
+			continue
+		}
+		err = os.RemoveAll(pathname)
+		lock.Unlock()
+		os.Remove(pathname + ".lock")
+		if err != nil {
 			return perrors.Wrapf(err, "clearing cache for %q", transports.ImageName(b))
 		}
 	}
@@ -0,0 +1,259 @@
+package blobcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/containers/image/v5/internal/blobinfocache"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	perrors "github.com/pkg/errors"
+)
+
+// blobInfoCacheFile is the name, relative to a BlobCache's directory, of the index that
+// records the metadata BlobInfoCache2 needs: digest pairs, compression algorithms, and
+// known blob locations. It sits next to the cached blobs themselves so that the directory
+// stays self-contained.
+const blobInfoCacheFile = "blobinfocache.json"
+
+// blobCacheIndex is the on-disk representation of a BlobCache's blob info cache.  It is
+// re-read from disk and written back on every access (see withBlobInfoCache), which is
+// adequate for the low-frequency, small-footprint updates this cache sees.
+type blobCacheIndex struct {
+	UncompressedDigests map[digest.Digest]digest.Digest            `json:"uncompressed-digests,omitempty"`
+	DigestCompressors   map[digest.Digest]string                   `json:"digest-compressors,omitempty"`
+	KnownLocations      map[string]map[string]map[string]time.Time `json:"known-locations,omitempty"` // transport -> scope -> location -> time
+}
+
+// unknownCompression is the compressor name that, once recorded for a digest, marks that blob
+// as stored uncompressed. A digest with no recorded compressor is read back with this same name
+// by compressorFor; only UncompressedDigest tells the two cases apart.
+const unknownCompression = ""
+
+// localLocationOpaquePrefix marks a BICLocationReference.Opaque value that CandidateLocations2
+// makes up itself, meaning "this digest is present directly in this BlobCache's own directory",
+// as opposed to a location some transport previously reported via RecordKnownLocation. Since it
+// doesn't depend on the requested transport/scope matching anything, it's what lets copy.Image
+// reuse a blob that was cached while copying one image for a later copy to an unrelated
+// destination, without re-reading the file by digest from wherever it originally came from.
+const localLocationOpaquePrefix = "blobcache-local:"
+
+func (b *BlobCache) loadBlobInfoCache() (*blobCacheIndex, error) {
+	index := &blobCacheIndex{
+		UncompressedDigests: make(map[digest.Digest]digest.Digest),
+		DigestCompressors:   make(map[digest.Digest]string),
+		KnownLocations:      make(map[string]map[string]map[string]time.Time),
+	}
+	data, err := os.ReadFile(filepath.Join(b.directory, blobInfoCacheFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return index, nil
+		}
+		return nil, perrors.Wrap(err, "reading blob info cache index")
+	}
+	if len(data) == 0 {
+		return index, nil
+	}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, perrors.Wrap(err, "parsing blob info cache index")
+	}
+	if index.UncompressedDigests == nil {
+		index.UncompressedDigests = make(map[digest.Digest]digest.Digest)
+	}
+	if index.DigestCompressors == nil {
+		index.DigestCompressors = make(map[digest.Digest]string)
+	}
+	if index.KnownLocations == nil {
+		index.KnownLocations = make(map[string]map[string]map[string]time.Time)
+	}
+	return index, nil
+}
+
+// withBlobInfoCache serializes access to the on-disk index and persists it after fn returns
+// without error. The in-process mutex and the flock on blobInfoCacheFile together make this
+// safe against both concurrent goroutines in this process and other processes sharing the same
+// cache directory (e.g. several "podman pull"s through the same mirror), so that they never
+// race a read-modify-write of the index and silently clobber each other's records.
+func (b *BlobCache) withBlobInfoCache(fn func(index *blobCacheIndex) error) error {
+	b.blobInfoCacheMutex.Lock()
+	defer b.blobInfoCacheMutex.Unlock()
+	path := filepath.Join(b.directory, blobInfoCacheFile)
+	lock, err := lockPath(path)
+	if err != nil {
+		return fmt.Errorf("locking %q: %w", path, err)
+	}
+	defer lock.Unlock()
+	index, err := b.loadBlobInfoCache()
+	if err != nil {
+		return err
+	}
+	if err := fn(index); err != nil {
+		return err
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return perrors.Wrap(err, "encoding blob info cache index")
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+func (b *BlobCache) Open() {
+}
+
+func (b *BlobCache) Close() {
+}
+
+func (b *BlobCache) UncompressedDigest(anyDigest digest.Digest) digest.Digest {
+	var uncompressed digest.Digest
+	_ = b.withBlobInfoCache(func(index *blobCacheIndex) error {
+		if d, ok := index.UncompressedDigests[anyDigest]; ok {
+			uncompressed = d
+		} else if compressor, ok := index.DigestCompressors[anyDigest]; ok && compressor == unknownCompression {
+			uncompressed = anyDigest
+		}
+		return nil
+	})
+	return uncompressed
+}
+
+func (b *BlobCache) RecordDigestUncompressedPair(anyDigest digest.Digest, uncompressed digest.Digest) {
+	_ = b.withBlobInfoCache(func(index *blobCacheIndex) error {
+		index.UncompressedDigests[anyDigest] = uncompressed
+		return nil
+	})
+}
+
+func (b *BlobCache) RecordDigestCompressorData(anyDigest digest.Digest, data blobinfocache.DigestCompressorData) {
+	_ = b.withBlobInfoCache(func(index *blobCacheIndex) error {
+		index.DigestCompressors[anyDigest] = data.BaseVariantCompressor
+		return nil
+	})
+}
+
+func (b *BlobCache) RecordKnownLocation(transport types.ImageTransport, scope types.BICTransportScope, blobDigest digest.Digest, location types.BICLocationReference) {
+	_ = b.withBlobInfoCache(func(index *blobCacheIndex) error {
+		byScope, ok := index.KnownLocations[transport.Name()]
+		if !ok {
+			byScope = make(map[string]map[string]time.Time)
+			index.KnownLocations[transport.Name()] = byScope
+		}
+		byDigest, ok := byScope[scope.Opaque]
+		if !ok {
+			byDigest = make(map[string]time.Time)
+			byScope[scope.Opaque] = byDigest
+		}
+		byDigest[location.Opaque+"@"+blobDigest.String()] = time.Now()
+		return nil
+	})
+}
+
+func (b *BlobCache) CandidateLocations(transport types.ImageTransport, scope types.BICTransportScope, primaryDigest digest.Digest, canSubstitute bool) []types.BICReplacementCandidate {
+	candidates2 := b.CandidateLocations2(transport, scope, primaryDigest, blobinfocache.CandidateLocations2Options{CanSubstitute: canSubstitute})
+	candidates := make([]types.BICReplacementCandidate, 0, len(candidates2))
+	for _, c := range candidates2 {
+		candidates = append(candidates, types.BICReplacementCandidate{Digest: c.Digest, Location: c.Location})
+	}
+	return candidates
+}
+
+func (b *BlobCache) CandidateLocations2(transport types.ImageTransport, scope types.BICTransportScope, primaryDigest digest.Digest, options blobinfocache.CandidateLocations2Options) []blobinfocache.BICReplacementCandidate2 {
+	var candidates []blobinfocache.BICReplacementCandidate2
+	digests := []digest.Digest{primaryDigest}
+	if options.CanSubstitute {
+		if u := b.UncompressedDigest(primaryDigest); u != "" && u != primaryDigest {
+			digests = append(digests, u)
+		}
+	}
+	_ = b.withBlobInfoCache(func(index *blobCacheIndex) error {
+		byScope, ok := index.KnownLocations[transport.Name()]
+		if !ok {
+			return nil
+		}
+		byDigest, ok := byScope[scope.Opaque]
+		if !ok {
+			return nil
+		}
+		for key := range byDigest {
+			for _, d := range digests {
+				suffix := "@" + d.String()
+				if len(key) > len(suffix) && key[len(key)-len(suffix):] == suffix {
+					candidates = append(candidates, b.newCandidate(d, index.DigestCompressors[d], types.BICLocationReference{Opaque: key[:len(key)-len(suffix)]}))
+				}
+			}
+		}
+		return nil
+	})
+	for _, d := range digests {
+		if present, _, _ := b.HasBlob(types.BlobInfo{Digest: d, Size: -1}); present {
+			candidates = append(candidates, b.newCandidate(d, b.compressorFor(d), types.BICLocationReference{Opaque: localLocationOpaquePrefix + b.directory}))
+		}
+	}
+	b.sortCandidatesByPreference(candidates)
+	return candidates
+}
+
+// newCandidate builds a BICReplacementCandidate2 for a cached digest, translating the
+// compressor name this package keeps in its own index into the CompressionOperation/
+// CompressionAlgorithm pair the interface actually uses: an empty/unknown compressor name
+// means the blob is stored uncompressed, anything else names the algorithm it was compressed
+// with. An unrecognized algorithm name degrades to "uncompressed" rather than erroring, since
+// CandidateLocations2 has no way to report a failure for a single candidate.
+func (b *BlobCache) newCandidate(d digest.Digest, compressorName string, location types.BICLocationReference) blobinfocache.BICReplacementCandidate2 {
+	if compressorName == unknownCompression {
+		return blobinfocache.BICReplacementCandidate2{
+			Digest:               d,
+			CompressionOperation: types.Decompress,
+			Location:             location,
+		}
+	}
+	algorithm, err := compression.AlgorithmByName(compressorName)
+	if err != nil {
+		return blobinfocache.BICReplacementCandidate2{
+			Digest:               d,
+			CompressionOperation: types.Decompress,
+			Location:             location,
+		}
+	}
+	return blobinfocache.BICReplacementCandidate2{
+		Digest:               d,
+		CompressionOperation: types.Compress,
+		CompressionAlgorithm: &algorithm,
+		Location:             location,
+	}
+}
+
+// compressionRank orders compressor names by the cache's configured preference: zstd:chunked
+// first when PreferChunked is set, then the order given in CompressionAlgorithms, then
+// everything else tied for last.
+func (b *BlobCache) compressionRank(compressorName string) int {
+	if b.preferChunked && compressorName == compressionZstdChunked {
+		return 0
+	}
+	for i, alg := range b.compressionAlgorithms {
+		if alg.Name() == compressorName {
+			return i + 1
+		}
+	}
+	return len(b.compressionAlgorithms) + 1
+}
+
+// sortCandidatesByPreference orders candidates so that substitutes matching the cache's
+// configured compression preference (zstd:chunked first when PreferChunked is set, then the
+// order given in CompressionAlgorithms) sort ahead of everything else, stably preserving the
+// relative order of equally-preferred candidates.
+func (b *BlobCache) sortCandidatesByPreference(candidates []blobinfocache.BICReplacementCandidate2) {
+	compressorName := func(c blobinfocache.BICReplacementCandidate2) string {
+		if c.CompressionAlgorithm == nil {
+			return unknownCompression
+		}
+		return c.CompressionAlgorithm.Name()
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return b.compressionRank(compressorName(candidates[i])) < b.compressionRank(compressorName(candidates[j]))
+	})
+}
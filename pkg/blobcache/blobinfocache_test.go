@@ -0,0 +1,138 @@
+package blobcache
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containers/image/v5/internal/blobinfocache"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// unusedTransportScope and unusedTransport stand in for a transport/scope that this BlobCache
+// has never seen via RecordKnownLocation, to exercise the self-referential "this digest is
+// present in my own directory" candidate, which must not depend on that match.
+var unusedTransportScope = types.BICTransportScope{Opaque: "some-other-registry.example.com/unrelated/repo"}
+
+func TestCandidateLocations2FindsLocallyCachedBlobAcrossUnrelatedScopes(t *testing.T) {
+	dir := t.TempDir()
+	ref, err := transports.ParseImageName("dir:" + dir)
+	if err != nil {
+		t.Fatalf("parsing reference: %v", err)
+	}
+	b, err := NewBlobCache(ref, t.TempDir(), types.PreserveOriginal)
+	if err != nil {
+		t.Fatalf("NewBlobCache: %v", err)
+	}
+	blobDigest := digest.FromString("some blob contents")
+	writeFakeBlob(t, b, blobDigest, "some blob contents")
+
+	candidates := b.CandidateLocations2(ref.Transport(), unusedTransportScope, blobDigest, blobinfocache.CandidateLocations2Options{})
+	var found bool
+	for _, c := range candidates {
+		if c.Digest == blobDigest && strings.HasPrefix(c.Location.Opaque, localLocationOpaquePrefix) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected a local-directory candidate for a blob present on disk regardless of transport/scope, got %+v", candidates)
+	}
+}
+
+func TestCandidateLocations2OmitsUncachedBlob(t *testing.T) {
+	dir := t.TempDir()
+	ref, err := transports.ParseImageName("dir:" + dir)
+	if err != nil {
+		t.Fatalf("parsing reference: %v", err)
+	}
+	b, err := NewBlobCache(ref, t.TempDir(), types.PreserveOriginal)
+	if err != nil {
+		t.Fatalf("NewBlobCache: %v", err)
+	}
+	candidates := b.CandidateLocations2(ref.Transport(), unusedTransportScope, digest.FromString("never cached"), blobinfocache.CandidateLocations2Options{})
+	if len(candidates) != 0 {
+		t.Errorf("expected no candidates for a digest never stored in the cache, got %+v", candidates)
+	}
+}
+
+func TestUncompressedDigestIsUnknownUntilRecorded(t *testing.T) {
+	b := newTestBlobCache(t)
+	anyDigest := digest.FromString("never recorded")
+	if u := b.UncompressedDigest(anyDigest); u != "" {
+		t.Errorf("UncompressedDigest(%s) = %q, want \"\" (unknown) for a digest nobody ever recorded anything about", anyDigest, u)
+	}
+}
+
+func TestUncompressedDigestReportsExplicitlyUncompressedBlob(t *testing.T) {
+	b := newTestBlobCache(t)
+	anyDigest := digest.FromString("an uncompressed blob")
+	b.RecordDigestCompressorData(anyDigest, blobinfocache.DigestCompressorData{BaseVariantCompressor: unknownCompression})
+	if u := b.UncompressedDigest(anyDigest); u != anyDigest {
+		t.Errorf("UncompressedDigest(%s) = %q, want the digest itself once it's been recorded as uncompressed", anyDigest, u)
+	}
+}
+
+func TestCandidateLocations2ReportsCompressionOfSubstitutes(t *testing.T) {
+	b := newTestBlobCache(t)
+	uncompressedDigest := digest.FromString("uncompressed content")
+	compressedDigest := digest.FromString("compressed content")
+	writeFakeBlob(t, b, uncompressedDigest, "uncompressed content")
+	writeFakeBlob(t, b, compressedDigest, "compressed content")
+	b.RecordDigestUncompressedPair(compressedDigest, uncompressedDigest)
+	b.RecordDigestCompressorData(compressedDigest, blobinfocache.DigestCompressorData{BaseVariantCompressor: "gzip"})
+
+	candidates := b.CandidateLocations2(b.Transport(), unusedTransportScope, compressedDigest, blobinfocache.CandidateLocations2Options{CanSubstitute: true})
+	var sawUncompressed, sawCompressed bool
+	for _, c := range candidates {
+		switch c.Digest {
+		case uncompressedDigest:
+			sawUncompressed = true
+			if c.CompressionOperation != types.Decompress || c.CompressionAlgorithm != nil {
+				t.Errorf("uncompressed candidate reported as compressed: %+v", c)
+			}
+		case compressedDigest:
+			sawCompressed = true
+			if c.CompressionOperation != types.Compress || c.CompressionAlgorithm == nil || c.CompressionAlgorithm.Name() != "gzip" {
+				t.Errorf("compressed candidate didn't report its gzip compression: %+v", c)
+			}
+		}
+	}
+	if !sawUncompressed || !sawCompressed {
+		t.Errorf("expected both the requested digest and its substitute among candidates, got %+v", candidates)
+	}
+}
+
+func TestPreferredSubstitutePicksMostPreferredCompressedVariant(t *testing.T) {
+	b := newTestBlobCache(t)
+	b.preferChunked = true
+	uncompressedDigest := digest.FromString("uncompressed content")
+	gzipDigest := digest.FromString("gzip variant")
+	chunkedDigest := digest.FromString("zstd:chunked variant")
+	b.RecordDigestCompressorData(gzipDigest, blobinfocache.DigestCompressorData{BaseVariantCompressor: "gzip"})
+	b.RecordDigestCompressorData(chunkedDigest, blobinfocache.DigestCompressorData{BaseVariantCompressor: compressionZstdChunked})
+	// Record the gzip variant first, so a substitute picker that just takes the first or last
+	// recorded relative instead of ranking by preference would get this wrong.
+	b.noteDigest(uncompressedDigest, compressedNote, gzipDigest)
+	b.noteDigest(uncompressedDigest, compressedNote, chunkedDigest)
+
+	substitute, ok := b.preferredSubstitute(uncompressedDigest)
+	if !ok {
+		t.Fatalf("preferredSubstitute(%s) found nothing, want the zstd:chunked variant", uncompressedDigest)
+	}
+	if substitute != chunkedDigest {
+		t.Errorf("preferredSubstitute(%s) = %s, want the PreferChunked-preferred variant %s", uncompressedDigest, substitute, chunkedDigest)
+	}
+}
+
+// writeFakeBlob writes content directly under the digest's cache filename, bypassing the
+// destination/source write paths, to set up a precondition for CandidateLocations2 tests.
+func writeFakeBlob(t *testing.T, b *BlobCache, blobDigest digest.Digest, content string) {
+	t.Helper()
+	filename := filepath.Join(b.Directory(), makeFilename(blobDigest, false))
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatalf("writing fake blob: %v", err)
+	}
+}
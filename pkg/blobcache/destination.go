@@ -0,0 +1,172 @@
+package blobcache
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"sync"
+
+	"github.com/containers/image/v5/internal/blobinfocache"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	perrors "github.com/pkg/errors"
+)
+
+type blobCacheDestination struct {
+	reference   *BlobCache
+	destination types.ImageDestination
+	// unpinMutex guards unpin: copy.Image calls PutBlob for several blobs of the same image
+	// concurrently, and each call appends to unpin on success.
+	unpinMutex sync.Mutex
+	// unpin releases the pins acquired for each blob this destination has stored, keeping
+	// them safe from eviction for the lifetime of the copy they belong to.
+	unpin []func()
+}
+
+func (b *BlobCache) NewImageDestination(ctx context.Context, sys *types.SystemContext) (types.ImageDestination, error) {
+	dest, err := b.reference.NewImageDestination(ctx, sys)
+	if err != nil {
+		return nil, perrors.Wrapf(err, "error creating new image destination")
+	}
+	return &blobCacheDestination{reference: b, destination: dest}, nil
+}
+
+func (d *blobCacheDestination) Reference() types.ImageReference {
+	return d.reference
+}
+
+func (d *blobCacheDestination) Close() error {
+	d.unpinMutex.Lock()
+	unpin := d.unpin
+	d.unpin = nil
+	d.unpinMutex.Unlock()
+	for _, f := range unpin {
+		f()
+	}
+	return d.destination.Close()
+}
+
+func (d *blobCacheDestination) SupportedManifestMIMETypes() []string {
+	return d.destination.SupportedManifestMIMETypes()
+}
+
+func (d *blobCacheDestination) SupportsSignatures(ctx context.Context) error {
+	return d.destination.SupportsSignatures(ctx)
+}
+
+func (d *blobCacheDestination) DesiredLayerCompression() types.LayerCompression {
+	return d.reference.compress
+}
+
+func (d *blobCacheDestination) AcceptsForeignLayerURLs() bool {
+	return d.destination.AcceptsForeignLayerURLs()
+}
+
+func (d *blobCacheDestination) MustMatchRuntimeOS() bool {
+	return d.destination.MustMatchRuntimeOS()
+}
+
+func (d *blobCacheDestination) IgnoresEmbeddedDockerReference() bool {
+	return d.destination.IgnoresEmbeddedDockerReference()
+}
+
+func (d *blobCacheDestination) HasThreadSafePutBlob() bool {
+	return d.destination.HasThreadSafePutBlob()
+}
+
+// saveStream writes a copy of stream to the cache directory under the blob's digest while
+// forwarding every byte read to the caller.  The copy is written to a temporary file and only
+// renamed into place when the returned function is called with save == true (PutBlob passes
+// whether the underlying destination accepted the blob), under a per-digest lock, so that two callers racing to
+// cache the same blob can't truncate or interleave each other's writes.
+func (d *blobCacheDestination) saveStream(stream io.Reader, isConfig bool, digest digest.Digest) (io.Reader, func(save bool)) {
+	filename := filepath.Join(d.reference.directory, makeFilename(digest, isConfig))
+	writer, err := newCacheFileWriter(filename)
+	if err != nil {
+		return stream, func(bool) {}
+	}
+	pipeReader, pipeWriter := io.Pipe()
+	teedReader := io.TeeReader(stream, pipeWriter)
+	copyDone := make(chan struct{})
+	go func() {
+		_, err := io.Copy(writer, pipeReader)
+		pipeReader.CloseWithError(err)
+		close(copyDone)
+	}()
+	return teedReader, func(save bool) {
+		pipeWriter.Close()
+		<-copyDone
+		if save {
+			writer.Commit()
+		} else {
+			writer.Abandon()
+		}
+	}
+}
+
+func (d *blobCacheDestination) PutBlob(ctx context.Context, stream io.Reader, inputInfo types.BlobInfo, cache types.BlobInfoCache, isConfig bool) (types.BlobInfo, error) {
+	if inputInfo.Digest != "" {
+		teed, finish := d.saveStream(stream, isConfig, inputInfo.Digest)
+		newInfo, err := d.destination.PutBlob(ctx, teed, inputInfo, cache, isConfig)
+		finish(err == nil)
+		if err == nil {
+			d.recordCompression(newInfo, isConfig)
+			d.reference.touch(newInfo.Digest)
+			unpin := d.reference.Pin(newInfo.Digest)
+			d.unpinMutex.Lock()
+			d.unpin = append(d.unpin, unpin)
+			d.unpinMutex.Unlock()
+			d.reference.enforceLimits()
+		}
+		return newInfo, err
+	}
+	return d.destination.PutBlob(ctx, stream, inputInfo, cache, isConfig)
+}
+
+// recordCompression notes the compression algorithm a just-stored blob was written in. If the
+// blob's uncompressed counterpart is already known, it also links the two cached copies together
+// so GetBlob and TryReusingBlob can substitute one for the other.
+func (d *blobCacheDestination) recordCompression(info types.BlobInfo, isConfig bool) {
+	if isConfig || info.CompressionAlgorithm == nil {
+		return
+	}
+	d.reference.RecordDigestCompressorData(info.Digest, blobinfocache.DigestCompressorData{
+		BaseVariantCompressor: info.CompressionAlgorithm.Name(),
+	})
+	if uncompressed := d.reference.UncompressedDigest(info.Digest); uncompressed != "" && uncompressed != info.Digest {
+		if present, _, _ := d.reference.HasBlob(types.BlobInfo{Digest: uncompressed, Size: -1}); present {
+			d.reference.noteDigest(uncompressed, compressedNote, info.Digest)
+			d.reference.noteDigest(info.Digest, decompressedNote, uncompressed)
+		}
+	}
+}
+
+// SupportsPutBlobPartial always reports false: partial/chunked puts are a capability real
+// destinations advertise through an internal interface this wrapper doesn't have access to
+// without also wrapping partial-put support itself, which this cache doesn't implement.
+func (d *blobCacheDestination) SupportsPutBlobPartial() bool {
+	return false
+}
+
+func (d *blobCacheDestination) TryReusingBlob(ctx context.Context, blobinfo types.BlobInfo, cache types.BlobInfoCache, canSubstitute bool) (bool, types.BlobInfo, error) {
+	if canSubstitute {
+		if substitute, ok := d.reference.preferredSubstitute(blobinfo.Digest); ok {
+			if present, size, _ := d.reference.HasBlob(types.BlobInfo{Digest: substitute, Size: -1}); present {
+				blobinfo = types.BlobInfo{Digest: substitute, Size: size}
+			}
+		}
+	}
+	return d.destination.TryReusingBlob(ctx, blobinfo, cache, canSubstitute)
+}
+
+func (d *blobCacheDestination) PutManifest(ctx context.Context, manifest []byte, instanceDigest *digest.Digest) error {
+	return d.destination.PutManifest(ctx, manifest, instanceDigest)
+}
+
+func (d *blobCacheDestination) PutSignatures(ctx context.Context, signatures [][]byte, instanceDigest *digest.Digest) error {
+	return d.destination.PutSignatures(ctx, signatures, instanceDigest)
+}
+
+func (d *blobCacheDestination) Commit(ctx context.Context, unparsedToplevel types.UnparsedImage) error {
+	return d.destination.Commit(ctx, unparsedToplevel)
+}
@@ -0,0 +1,80 @@
+package blobcache
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// fakeImageDestination is a minimal types.ImageDestination stub that just drains whatever it's
+// given and echoes back the BlobInfo it was passed, so destination_test.go can drive
+// blobCacheDestination.PutBlob without a real transport.
+type fakeImageDestination struct{}
+
+func (f *fakeImageDestination) Reference() types.ImageReference              { return nil }
+func (f *fakeImageDestination) Close() error                                 { return nil }
+func (f *fakeImageDestination) SupportedManifestMIMETypes() []string         { return nil }
+func (f *fakeImageDestination) SupportsSignatures(ctx context.Context) error { return nil }
+func (f *fakeImageDestination) DesiredLayerCompression() types.LayerCompression {
+	return types.PreserveOriginal
+}
+func (f *fakeImageDestination) AcceptsForeignLayerURLs() bool        { return false }
+func (f *fakeImageDestination) MustMatchRuntimeOS() bool             { return false }
+func (f *fakeImageDestination) IgnoresEmbeddedDockerReference() bool { return false }
+func (f *fakeImageDestination) HasThreadSafePutBlob() bool           { return true }
+func (f *fakeImageDestination) PutBlob(ctx context.Context, stream io.Reader, inputInfo types.BlobInfo, cache types.BlobInfoCache, isConfig bool) (types.BlobInfo, error) {
+	if _, err := io.Copy(io.Discard, stream); err != nil {
+		return types.BlobInfo{}, err
+	}
+	return inputInfo, nil
+}
+func (f *fakeImageDestination) SupportsPutBlobPartial() bool { return false }
+func (f *fakeImageDestination) TryReusingBlob(ctx context.Context, blobinfo types.BlobInfo, cache types.BlobInfoCache, canSubstitute bool) (bool, types.BlobInfo, error) {
+	return false, types.BlobInfo{}, nil
+}
+func (f *fakeImageDestination) PutManifest(ctx context.Context, manifest []byte, instanceDigest *digest.Digest) error {
+	return nil
+}
+func (f *fakeImageDestination) PutSignatures(ctx context.Context, signatures [][]byte, instanceDigest *digest.Digest) error {
+	return nil
+}
+func (f *fakeImageDestination) Commit(ctx context.Context, unparsedToplevel types.UnparsedImage) error {
+	return nil
+}
+
+// TestConcurrentPutBlobsDoNotRaceOnUnpin is a regression test for a data race: copy.Image calls
+// PutBlob for several blobs of the same image concurrently, and each successful call used to
+// append to d.unpin with no synchronization. Run with -race to catch a regression.
+func TestConcurrentPutBlobsDoNotRaceOnUnpin(t *testing.T) {
+	b := newTestBlobCache(t)
+	d := &blobCacheDestination{reference: b, destination: &fakeImageDestination{}}
+
+	const n = 8
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			content := strconv.Itoa(i)
+			blobDigest := digest.FromString(content)
+			info := types.BlobInfo{Digest: blobDigest, Size: int64(len(content))}
+			if _, err := d.PutBlob(context.Background(), strings.NewReader(content), info, nil, false); err != nil {
+				t.Errorf("PutBlob: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(d.unpin) != n {
+		t.Errorf("len(d.unpin) = %d, want %d", len(d.unpin), n)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
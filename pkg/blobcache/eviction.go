@@ -0,0 +1,216 @@
+package blobcache
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	perrors "github.com/pkg/errors"
+)
+
+// accessIndexFile is the name, relative to a BlobCache's directory, of the sidecar journal
+// that records when each blob was last read or written, since the filesystem's own mtime is
+// disturbed by the atomic-rename write path and we don't want to rely on access-time mount
+// options being enabled.
+const accessIndexFile = "access.json"
+
+type accessIndex struct {
+	Access map[digest.Digest]time.Time `json:"access,omitempty"`
+}
+
+func (b *BlobCache) loadAccessIndex() (*accessIndex, error) {
+	index := &accessIndex{Access: make(map[digest.Digest]time.Time)}
+	data, err := os.ReadFile(filepath.Join(b.directory, accessIndexFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return index, nil
+		}
+		return nil, perrors.Wrap(err, "reading access index")
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, index); err != nil {
+			return nil, perrors.Wrap(err, "parsing access index")
+		}
+	}
+	if index.Access == nil {
+		index.Access = make(map[digest.Digest]time.Time)
+	}
+	return index, nil
+}
+
+// touch records that blobDigest was just read or written, for LRU and MaxAge accounting. Like
+// withBlobInfoCache, it's guarded by both an in-process mutex and a flock on accessIndexFile,
+// since several processes sharing a cache directory can touch blobs at the same time.
+func (b *BlobCache) touch(blobDigest digest.Digest) {
+	b.accessMutex.Lock()
+	defer b.accessMutex.Unlock()
+	path := filepath.Join(b.directory, accessIndexFile)
+	lock, err := lockPath(path)
+	if err != nil {
+		return
+	}
+	defer lock.Unlock()
+	index, err := b.loadAccessIndex()
+	if err != nil {
+		return
+	}
+	index.Access[blobDigest] = time.Now()
+	data, err := json.Marshal(index)
+	if err != nil {
+		return
+	}
+	_ = os.WriteFile(path, data, 0600)
+}
+
+// Pin marks digests as ineligible for eviction by Prune or automatic size-bounded eviction
+// until the returned function is called, which is how a copy in progress keeps the blobs of
+// the manifest it's currently handling from being evicted out from under it. Pins nest: a
+// digest pinned by two callers stays pinned until both unpin it.
+func (b *BlobCache) Pin(digests ...digest.Digest) func() {
+	b.pinMutex.Lock()
+	for _, d := range digests {
+		b.pinned[d]++
+	}
+	b.pinMutex.Unlock()
+	return func() {
+		b.pinMutex.Lock()
+		for _, d := range digests {
+			if b.pinned[d] > 1 {
+				b.pinned[d]--
+			} else {
+				delete(b.pinned, d)
+			}
+		}
+		b.pinMutex.Unlock()
+	}
+}
+
+func (b *BlobCache) isPinned(blobDigest digest.Digest) bool {
+	b.pinMutex.Lock()
+	defer b.pinMutex.Unlock()
+	return b.pinned[blobDigest] > 0
+}
+
+// cachedBlob describes one evictable entry found in the cache directory.
+type cachedBlob struct {
+	digest   digest.Digest
+	isConfig bool
+	size     int64
+}
+
+// cachedBlobs lists the blobs and configs (not metadata sidecars) currently stored in the
+// cache directory, marking configs with isConfig.
+func (b *BlobCache) cachedBlobs() ([]cachedBlob, error) {
+	f, err := os.Open(b.directory)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, perrors.Wrapf(err, "reading directory %q", b.directory)
+	}
+	var blobs []cachedBlob
+	for _, name := range names {
+		if isTempCacheFile(name) || name == accessIndexFile || name == blobInfoCacheFile {
+			continue
+		}
+		isConfig := strings.HasSuffix(name, ".config")
+		base := strings.TrimSuffix(name, ".config")
+		if strings.HasSuffix(base, compressedNote) || strings.HasSuffix(base, decompressedNote) {
+			continue
+		}
+		d, err := digest.Parse(base)
+		if err != nil {
+			continue
+		}
+		fi, err := os.Stat(filepath.Join(b.directory, name))
+		if err != nil {
+			continue
+		}
+		blobs = append(blobs, cachedBlob{digest: d, isConfig: isConfig, size: fi.Size()})
+	}
+	return blobs, nil
+}
+
+// Prune evicts the least-recently-used non-config, unpinned blobs from the cache until its
+// total size (configs excluded) is at or below target, or there's nothing left to evict, and
+// reports how many bytes were freed.
+func (b *BlobCache) Prune(ctx context.Context, target int64) (int64, error) {
+	blobs, err := b.cachedBlobs()
+	if err != nil {
+		return 0, err
+	}
+	access, err := b.loadAccessIndex()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	var evictable []cachedBlob
+	for _, blob := range blobs {
+		if blob.isConfig {
+			continue
+		}
+		total += blob.size
+		if !b.isPinned(blob.digest) {
+			evictable = append(evictable, blob)
+		}
+	}
+	sort.Slice(evictable, func(i, j int) bool {
+		return access.Access[evictable[i].digest].Before(access.Access[evictable[j].digest])
+	})
+	var freed int64
+	for _, blob := range evictable {
+		if total <= target {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return freed, err
+		}
+		if err := os.Remove(filepath.Join(b.directory, makeFilename(blob.digest, false))); err != nil && !os.IsNotExist(err) {
+			return freed, perrors.Wrapf(err, "evicting blob %q", blob.digest)
+		}
+		total -= blob.size
+		freed += blob.size
+	}
+	return freed, nil
+}
+
+// pruneExpired evicts blobs that haven't been touched in longer than b.maxAge; it's a no-op
+// unless MaxAge was set.
+func (b *BlobCache) pruneExpired() {
+	if b.maxAge <= 0 {
+		return
+	}
+	blobs, err := b.cachedBlobs()
+	if err != nil {
+		return
+	}
+	access, err := b.loadAccessIndex()
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-b.maxAge)
+	for _, blob := range blobs {
+		if blob.isConfig || b.isPinned(blob.digest) {
+			continue
+		}
+		if last, ok := access.Access[blob.digest]; ok && last.After(cutoff) {
+			continue
+		}
+		os.Remove(filepath.Join(b.directory, makeFilename(blob.digest, false)))
+	}
+}
+
+// enforceLimits applies MaxAge and then MaxBytes after a blob was added to the cache.
+func (b *BlobCache) enforceLimits() {
+	b.pruneExpired()
+	if b.maxBytes > 0 {
+		_, _ = b.Prune(context.Background(), b.maxBytes)
+	}
+}
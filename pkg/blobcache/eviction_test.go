@@ -0,0 +1,84 @@
+package blobcache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func newTestBlobCache(t *testing.T) *BlobCache {
+	t.Helper()
+	dir := t.TempDir()
+	ref, err := transports.ParseImageName("dir:" + dir)
+	if err != nil {
+		t.Fatalf("parsing reference: %v", err)
+	}
+	b, err := NewBlobCache(ref, t.TempDir(), types.PreserveOriginal)
+	if err != nil {
+		t.Fatalf("NewBlobCache: %v", err)
+	}
+	return b
+}
+
+func TestPruneEvictsLeastRecentlyUsedUnpinnedBlobs(t *testing.T) {
+	b := newTestBlobCache(t)
+	old := digest.FromString("old blob")
+	newer := digest.FromString("newer blob")
+	writeFakeBlob(t, b, old, "old blob")
+	writeFakeBlob(t, b, newer, "newer blob")
+	b.touch(old)
+	time.Sleep(10 * time.Millisecond)
+	b.touch(newer)
+
+	// A target equal to the newer blob's size leaves room for exactly one of the two blobs.
+	freed, err := b.Prune(context.Background(), int64(len("newer blob")))
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if freed != int64(len("old blob")) {
+		t.Errorf("freed = %d, want only the older blob's size (%d)", freed, len("old blob"))
+	}
+	if present, _, _ := b.HasBlob(types.BlobInfo{Digest: old, Size: -1}); present {
+		t.Errorf("expected the older, least-recently-used blob to have been evicted")
+	}
+	if present, _, _ := b.HasBlob(types.BlobInfo{Digest: newer, Size: -1}); !present {
+		t.Errorf("expected the more recently touched blob to survive pruning to this target")
+	}
+}
+
+func TestPruneSkipsPinnedBlobs(t *testing.T) {
+	b := newTestBlobCache(t)
+	pinned := digest.FromString("pinned blob")
+	unpinned := digest.FromString("unpinned blob")
+	writeFakeBlob(t, b, pinned, "pinned blob")
+	writeFakeBlob(t, b, unpinned, "unpinned blob")
+	b.touch(pinned)
+	b.touch(unpinned)
+
+	unpin := b.Pin(pinned)
+	defer unpin()
+
+	if _, err := b.Prune(context.Background(), 0); err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if present, _, _ := b.HasBlob(types.BlobInfo{Digest: pinned, Size: -1}); !present {
+		t.Errorf("expected a pinned blob to survive Prune even when it's the least-recently-used")
+	}
+	if present, _, _ := b.HasBlob(types.BlobInfo{Digest: unpinned, Size: -1}); present {
+		t.Errorf("expected the unpinned blob to be evicted to reach target 0")
+	}
+
+	unpin()
+	if _, err := b.Prune(context.Background(), 0); err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(b.Directory(), makeFilename(pinned, false))); !os.IsNotExist(err) {
+		t.Errorf("expected the formerly-pinned blob to be evictable once unpinned, stat error: %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+//go:build !windows
+// +build !windows
+
+package blobcache
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileLock guards a single cache entry against concurrent writers, including ones in other
+// processes, using flock(2) on a sidecar ".lock" file.
+type fileLock struct {
+	f *os.File
+}
+
+// lockPath blocks until it holds an exclusive lock for path.
+func lockPath(path string) (*fileLock, error) {
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileLock{f: f}, nil
+}
+
+// tryLockPath acquires an exclusive lock for path without blocking, returning ok == false if
+// some other process already holds it.
+func tryLockPath(path string) (lock *fileLock, ok bool, err error) {
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		f.Close()
+		if err == unix.EWOULDBLOCK {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return &fileLock{f: f}, true, nil
+}
+
+func (l *fileLock) Unlock() error {
+	err := unix.Flock(int(l.f.Fd()), unix.LOCK_UN)
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
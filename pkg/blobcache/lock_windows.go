@@ -0,0 +1,50 @@
+//go:build windows
+// +build windows
+
+package blobcache
+
+import "sync"
+
+// fileLock guards a single cache entry against concurrent writers within this process.
+// flock(2) has no equivalent in this build, so cross-process writers to the same directory
+// are not mutually exclusive on Windows.
+type fileLock struct {
+	mu *sync.Mutex
+}
+
+var (
+	inProcessLocksMutex sync.Mutex
+	inProcessLocks      = map[string]*sync.Mutex{}
+)
+
+func mutexFor(path string) *sync.Mutex {
+	inProcessLocksMutex.Lock()
+	defer inProcessLocksMutex.Unlock()
+	mu, ok := inProcessLocks[path]
+	if !ok {
+		mu = &sync.Mutex{}
+		inProcessLocks[path] = mu
+	}
+	return mu
+}
+
+// lockPath blocks until it holds path's in-process lock.
+func lockPath(path string) (*fileLock, error) {
+	mu := mutexFor(path)
+	mu.Lock()
+	return &fileLock{mu: mu}, nil
+}
+
+// tryLockPath acquires path's in-process lock without blocking.
+func tryLockPath(path string) (lock *fileLock, ok bool, err error) {
+	mu := mutexFor(path)
+	if !mu.TryLock() {
+		return nil, false, nil
+	}
+	return &fileLock{mu: mu}, true, nil
+}
+
+func (l *fileLock) Unlock() error {
+	l.mu.Unlock()
+	return nil
+}
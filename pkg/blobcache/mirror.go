@@ -0,0 +1,115 @@
+package blobcache
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	perrors "github.com/pkg/errors"
+)
+
+// blobPathPattern matches the blob-fetching subset of the Docker Registry v2 HTTP API:
+// GET/HEAD /v2/<name>/blobs/<digest>.  <name> may itself contain slashes, so it's matched
+// greedily up to the final "/blobs/" segment.
+var blobPathPattern = regexp.MustCompile(`^/v2/(.+)/blobs/([A-Za-z0-9+._-]+:[A-Fa-f0-9]+)$`)
+
+// MirrorHandler serves the blobs held in a BlobCache's directory over the read-only subset of
+// the Docker Registry v2 blob API, fetching a blob through the wrapped reference on a cache
+// miss the same way a blobCacheSource would. Pointing several "podman pull" or "buildah"
+// invocations at it as a registries.conf mirror (or docker.io/containers-storage-style
+// override) lets them reuse blobs that any BlobCache-wrapped reference previously fetched, or
+// trigger a one-time pull-through fetch of their own, without needing to share a process or
+// even an image reference.
+//
+// The registry's repository name component is accepted but otherwise ignored: lookups are
+// purely by digest, the same way BlobCache.HasBlob works.
+type MirrorHandler struct {
+	cache *BlobCache
+	sys   *types.SystemContext
+}
+
+// NewMirrorHandler creates an http.Handler that serves cache's blobs over the registry v2 blob
+// API, fetching misses through cache's wrapped reference using sys (which may be nil).
+func NewMirrorHandler(cache *BlobCache, sys *types.SystemContext) *MirrorHandler {
+	return &MirrorHandler{cache: cache, sys: sys}
+}
+
+// MirrorHandler returns an http.Handler that serves b's cached blobs over the registry v2 blob
+// API; see NewMirrorHandler.
+func (b *BlobCache) MirrorHandler(sys *types.SystemContext) http.Handler {
+	return NewMirrorHandler(b, sys)
+}
+
+func (m *MirrorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodHead)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	match := blobPathPattern.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		http.NotFound(w, r)
+		return
+	}
+	blobDigest, err := digest.Parse(match[2])
+	if err != nil {
+		http.Error(w, "invalid digest: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	present, _, err := m.cache.HasBlob(types.BlobInfo{Digest: blobDigest, Size: -1})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !present {
+		if err := m.pullThrough(r.Context(), blobDigest); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	filename := filepath.Join(m.cache.directory, makeFilename(blobDigest, false))
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// The config variant of the same digest; try that filename too.
+			f, err = os.Open(filepath.Join(m.cache.directory, makeFilename(blobDigest, true)))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	defer f.Close()
+	w.Header().Set("Docker-Content-Digest", blobDigest.String())
+	w.Header().Set("Content-Type", "application/octet-stream")
+	// http.ServeContent takes care of Range requests, conditional requests, and HEAD for us.
+	// Serving from the now-local file, rather than the stream we may have just pulled
+	// through, is what lets an interrupted downstream pull resume with a Range request
+	// instead of re-fetching the whole blob from the upstream registry again.
+	http.ServeContent(w, r, blobDigest.String(), time.Time{}, f)
+}
+
+// pullThrough fetches blobDigest through the cache's wrapped reference, which caches it to
+// disk as a side effect of the read, the same way any other blobCacheSource.GetBlob call does.
+func (m *MirrorHandler) pullThrough(ctx context.Context, blobDigest digest.Digest) error {
+	src, err := m.cache.NewImageSource(ctx, m.sys)
+	if err != nil {
+		return perrors.Wrap(err, "opening source to pull blob through")
+	}
+	defer src.Close()
+	rc, _, err := src.GetBlob(ctx, types.BlobInfo{Digest: blobDigest, Size: -1}, nil)
+	if err != nil {
+		return perrors.Wrapf(err, "pulling blob %q through", blobDigest)
+	}
+	defer rc.Close()
+	if _, err := io.Copy(io.Discard, rc); err != nil {
+		return perrors.Wrapf(err, "pulling blob %q through", blobDigest)
+	}
+	return nil
+}
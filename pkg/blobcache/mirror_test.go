@@ -0,0 +1,128 @@
+package blobcache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// fakeImageReference is a minimal types.ImageReference whose NewImageSource always hands back
+// the same fakeImageSource, so mirror_test.go can drive MirrorHandler's pull-through path
+// without a real transport.
+type fakeImageReference struct {
+	source *fakeImageSource
+}
+
+func (r *fakeImageReference) Transport() types.ImageTransport                          { return nil }
+func (r *fakeImageReference) StringWithinTransport() string                            { return "fake" }
+func (r *fakeImageReference) DockerReference() reference.Named                         { return nil }
+func (r *fakeImageReference) PolicyConfigurationIdentity() string                      { return "fake" }
+func (r *fakeImageReference) PolicyConfigurationNamespaces() []string                  { return nil }
+func (r *fakeImageReference) DeleteImage(ctx context.Context, sys *types.SystemContext) error {
+	return nil
+}
+func (r *fakeImageReference) NewImage(ctx context.Context, sys *types.SystemContext) (types.ImageCloser, error) {
+	return nil, nil
+}
+func (r *fakeImageReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	return r.source, nil
+}
+func (r *fakeImageReference) NewImageDestination(ctx context.Context, sys *types.SystemContext) (types.ImageDestination, error) {
+	return nil, nil
+}
+
+func TestMirrorHandlerPullsThroughOnMiss(t *testing.T) {
+	const content = "blob fetched through the mirror"
+	blobDigest := digest.FromString(content)
+	ref := &fakeImageReference{source: &fakeImageSource{content: content}}
+	b, err := NewBlobCache(ref, t.TempDir(), types.PreserveOriginal)
+	if err != nil {
+		t.Fatalf("NewBlobCache: %v", err)
+	}
+	handler := NewMirrorHandler(b, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/some/repo/blobs/"+blobDigest.String(), nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %q", rec.Code, rec.Body.String())
+	}
+	if rec.Body.String() != content {
+		t.Errorf("body = %q, want %q", rec.Body.String(), content)
+	}
+	if present, _, _ := b.HasBlob(types.BlobInfo{Digest: blobDigest, Size: -1}); !present {
+		t.Errorf("expected the pulled-through blob to be cached to disk afterwards")
+	}
+}
+
+func TestMirrorHandlerServesRangeRequestsFromCachedFile(t *testing.T) {
+	const content = "0123456789"
+	blobDigest := digest.FromString(content)
+	ref := &fakeImageReference{source: &fakeImageSource{content: content}}
+	b, err := NewBlobCache(ref, t.TempDir(), types.PreserveOriginal)
+	if err != nil {
+		t.Fatalf("NewBlobCache: %v", err)
+	}
+	writeFakeBlob(t, b, blobDigest, content)
+	handler := NewMirrorHandler(b, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/some/repo/blobs/"+blobDigest.String(), nil)
+	req.Header.Set("Range", "bytes=2-5")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("status = %d, want %d; body = %q", rec.Code, http.StatusPartialContent, rec.Body.String())
+	}
+	if got, want := rec.Body.String(), content[2:6]; got != want {
+		t.Errorf("range body = %q, want %q", got, want)
+	}
+}
+
+func TestMirrorHandlerHeadReturnsNoBody(t *testing.T) {
+	const content = "head request content"
+	blobDigest := digest.FromString(content)
+	ref := &fakeImageReference{source: &fakeImageSource{content: content}}
+	b, err := NewBlobCache(ref, t.TempDir(), types.PreserveOriginal)
+	if err != nil {
+		t.Fatalf("NewBlobCache: %v", err)
+	}
+	writeFakeBlob(t, b, blobDigest, content)
+	handler := NewMirrorHandler(b, nil)
+
+	req := httptest.NewRequest(http.MethodHead, "/v2/some/repo/blobs/"+blobDigest.String(), nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("HEAD response body = %q, want empty", rec.Body.String())
+	}
+}
+
+func TestMirrorHandlerUnknownDigestReturnsBadGateway(t *testing.T) {
+	ref := &fakeImageReference{source: &fakeImageSource{content: ""}}
+	b, err := NewBlobCache(ref, t.TempDir(), types.PreserveOriginal)
+	if err != nil {
+		t.Fatalf("NewBlobCache: %v", err)
+	}
+	// Make the upstream source fail, simulating a digest it doesn't actually have.
+	ref.source = &fakeImageSource{content: "", failGetBlob: true}
+	handler := NewMirrorHandler(b, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/some/repo/blobs/"+digest.FromString("missing").String(), nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, body = %q", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,164 @@
+package blobcache
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	perrors "github.com/pkg/errors"
+)
+
+type blobCacheSource struct {
+	reference *BlobCache
+	source    types.ImageSource
+}
+
+func (b *BlobCache) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	src, err := b.reference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, perrors.Wrapf(err, "error creating new image source")
+	}
+	return &blobCacheSource{reference: b, source: src}, nil
+}
+
+func (s *blobCacheSource) Reference() types.ImageReference {
+	return s.reference
+}
+
+func (s *blobCacheSource) Close() error {
+	return s.source.Close()
+}
+
+// save writes a copy of the blob being read to the cache directory, if it's not already
+// there, so that later readers (possibly of unrelated images) can reuse it.
+func (s *blobCacheSource) save(blobinfo types.BlobInfo, stream io.ReadCloser) (io.ReadCloser, error) {
+	present, _, err := s.reference.HasBlob(blobinfo)
+	if err != nil {
+		return nil, perrors.Wrap(err, "checking for a cached blob")
+	}
+	if present {
+		return stream, nil
+	}
+	filename := filepath.Join(s.reference.directory, makeFilename(blobinfo.Digest, false))
+	writer, err := newCacheFileWriter(filename)
+	if err != nil {
+		return nil, perrors.Wrapf(err, "creating cache file for blob %q", blobinfo.Digest)
+	}
+	return &teeReadCloser{
+		rc:           stream,
+		w:            writer,
+		expectedSize: blobinfo.Size,
+		onClose: func(complete bool) {
+			if !complete {
+				writer.Abandon()
+				return
+			}
+			if cerr := writer.Commit(); cerr == nil {
+				s.reference.touch(blobinfo.Digest)
+				s.reference.enforceLimits()
+			}
+		},
+	}, nil
+}
+
+// GetBlob serves blobinfo.Digest's exact bytes, from the cache directory when we already have
+// them and from the wrapped source otherwise. It deliberately does not substitute a cached
+// blob stored under some other digest (e.g. the uncompressed counterpart of a gzip blob): the
+// types.ImageSource.GetBlob contract is to return the content of the digest it was asked for,
+// and copy.Image verifies the returned stream against blobinfo.Digest, so handing back a
+// different digest's bytes here would just make every such read fail as "corrupt". Offering an
+// alternate-digest substitute is the destination side's job, via TryReusingBlob and
+// CandidateLocations2, which can tell the caller that the digest being reused differs from the
+// one it asked about.
+func (s *blobCacheSource) GetBlob(ctx context.Context, blobinfo types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	present, size, err := s.reference.HasBlob(blobinfo)
+	if err != nil {
+		return nil, -1, err
+	}
+	if present {
+		filename := filepath.Join(s.reference.directory, makeFilename(blobinfo.Digest, false))
+		f, err := os.Open(filename)
+		if err == nil {
+			s.reference.touch(blobinfo.Digest)
+			return f, size, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, -1, perrors.Wrapf(err, "opening cached blob %q", blobinfo.Digest)
+		}
+	}
+	stream, size, err := s.source.GetBlob(ctx, blobinfo, cache)
+	if err != nil {
+		return nil, -1, err
+	}
+	wrapped, err := s.save(blobinfo, stream)
+	if err != nil {
+		stream.Close()
+		return nil, -1, err
+	}
+	return wrapped, size, nil
+}
+
+func (s *blobCacheSource) HasThreadSafeGetBlob() bool {
+	return s.source.HasThreadSafeGetBlob()
+}
+
+func (s *blobCacheSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
+	return s.source.GetManifest(ctx, instanceDigest)
+}
+
+func (s *blobCacheSource) GetSignatures(ctx context.Context, instanceDigest *digest.Digest) ([][]byte, error) {
+	return s.source.GetSignatures(ctx, instanceDigest)
+}
+
+func (s *blobCacheSource) LayerInfosForCopy(ctx context.Context, instanceDigest *digest.Digest) ([]types.BlobInfo, error) {
+	return s.source.LayerInfosForCopy(ctx, instanceDigest)
+}
+
+// teeReadCloser copies everything read from rc to w, and once the caller closes the stream,
+// invokes onClose with whether the copy is actually complete: no read or write error occurred,
+// the underlying reader reached io.EOF (as opposed to being closed early, e.g. on context
+// cancellation or an aborted copy), and, when expectedSize is not negative, the number of
+// bytes copied matches it. Callers that commit whatever was written whenever Close returns a
+// nil error - instead of checking this - end up atomically renaming truncated reads into place
+// as if they were complete blobs, which then get served to every future reader as "cached".
+type teeReadCloser struct {
+	rc           io.ReadCloser
+	w            io.Writer
+	expectedSize int64
+	err          error
+	total        int64
+	reachedEOF   bool
+	onClose      func(complete bool)
+}
+
+func (t *teeReadCloser) Read(p []byte) (int, error) {
+	n, err := t.rc.Read(p)
+	if n > 0 {
+		t.total += int64(n)
+		if _, werr := t.w.Write(p[:n]); werr != nil && t.err == nil {
+			t.err = werr
+		}
+	}
+	if err == io.EOF {
+		t.reachedEOF = true
+	} else if err != nil && t.err == nil {
+		t.err = err
+	}
+	return n, err
+}
+
+func (t *teeReadCloser) Close() error {
+	err := t.rc.Close()
+	if err == nil {
+		err = t.err
+	}
+	complete := err == nil && t.reachedEOF
+	if complete && t.expectedSize >= 0 && t.total != t.expectedSize {
+		complete = false
+	}
+	t.onClose(complete)
+	return err
+}
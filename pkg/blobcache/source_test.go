@@ -0,0 +1,146 @@
+package blobcache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+)
+
+var errUnknownBlob = errors.New("fakeImageSource: no such blob")
+
+// fakeImageSource is a minimal types.ImageSource stub whose GetBlob always serves
+// fakeImageSource.content regardless of which digest is asked for, so tests can tell whether
+// blobCacheSource.GetBlob ever substitutes some other cached digest's bytes for the one it was
+// asked about.
+type fakeImageSource struct {
+	content string
+	// failGetBlob makes GetBlob return an error, simulating a digest the upstream doesn't have.
+	failGetBlob bool
+}
+
+func (f *fakeImageSource) Reference() types.ImageReference { return nil }
+func (f *fakeImageSource) Close() error                    { return nil }
+func (f *fakeImageSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
+	return nil, "", nil
+}
+func (f *fakeImageSource) HasThreadSafeGetBlob() bool { return false }
+func (f *fakeImageSource) GetBlob(ctx context.Context, blobinfo types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	if f.failGetBlob {
+		return nil, -1, errUnknownBlob
+	}
+	return io.NopCloser(strings.NewReader(f.content)), int64(len(f.content)), nil
+}
+func (f *fakeImageSource) GetSignatures(ctx context.Context, instanceDigest *digest.Digest) ([][]byte, error) {
+	return nil, nil
+}
+func (f *fakeImageSource) LayerInfosForCopy(ctx context.Context, instanceDigest *digest.Digest) ([]types.BlobInfo, error) {
+	return nil, nil
+}
+
+func TestGetBlobNeverSubstitutesADifferentDigest(t *testing.T) {
+	dir := t.TempDir()
+	ref, err := transports.ParseImageName("dir:" + dir)
+	if err != nil {
+		t.Fatalf("parsing reference: %v", err)
+	}
+	b, err := NewBlobCache(ref, t.TempDir(), types.PreserveOriginal)
+	if err != nil {
+		t.Fatalf("NewBlobCache: %v", err)
+	}
+	const requested = "requested blob content"
+	const unrelated = "some unrelated cached blob"
+	requestedDigest := digest.FromString(requested)
+	unrelatedDigest := digest.FromString(unrelated)
+	writeFakeBlob(t, b, unrelatedDigest, unrelated)
+	// Even if a compression-substitute relationship was recorded between the two digests,
+	// GetBlob must still serve exactly what was asked for.
+	b.noteDigest(requestedDigest, decompressedNote, unrelatedDigest)
+
+	src := &blobCacheSource{reference: b, source: &fakeImageSource{content: requested}}
+	rc, _, err := src.GetBlob(context.Background(), types.BlobInfo{Digest: requestedDigest, Size: int64(len(requested))}, nil)
+	if err != nil {
+		t.Fatalf("GetBlob: %v", err)
+	}
+	defer rc.Close()
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("reading: %v", err)
+	}
+	if string(got) != requested {
+		t.Errorf("GetBlob(%s) = %q, want %q (must never return another digest's content)", requestedDigest, got, requested)
+	}
+}
+
+func TestTeeReadCloserCompleteOnFullRead(t *testing.T) {
+	content := "hello world"
+	var buf bytes.Buffer
+	var gotComplete bool
+	tee := &teeReadCloser{
+		rc:           io.NopCloser(strings.NewReader(content)),
+		w:            &buf,
+		expectedSize: int64(len(content)),
+		onClose:      func(complete bool) { gotComplete = complete },
+	}
+	if _, err := io.ReadAll(tee); err != nil {
+		t.Fatalf("reading: %v", err)
+	}
+	if err := tee.Close(); err != nil {
+		t.Fatalf("closing: %v", err)
+	}
+	if !gotComplete {
+		t.Errorf("expected a fully-read stream matching expectedSize to be reported complete")
+	}
+	if buf.String() != content {
+		t.Errorf("tee wrote %q, want %q", buf.String(), content)
+	}
+}
+
+func TestTeeReadCloserIncompleteOnEarlyClose(t *testing.T) {
+	content := "hello world"
+	var buf bytes.Buffer
+	var gotComplete bool
+	tee := &teeReadCloser{
+		rc:           io.NopCloser(strings.NewReader(content)),
+		w:            &buf,
+		expectedSize: int64(len(content)),
+		onClose:      func(complete bool) { gotComplete = complete },
+	}
+	partial := make([]byte, 4)
+	if _, err := tee.Read(partial); err != nil {
+		t.Fatalf("reading: %v", err)
+	}
+	if err := tee.Close(); err != nil {
+		t.Fatalf("closing: %v", err)
+	}
+	if gotComplete {
+		t.Errorf("expected a stream closed before reaching EOF to be reported incomplete, even though Close returned no error")
+	}
+}
+
+func TestTeeReadCloserIncompleteOnSizeMismatch(t *testing.T) {
+	content := "hello world"
+	var buf bytes.Buffer
+	var gotComplete bool
+	tee := &teeReadCloser{
+		rc:           io.NopCloser(strings.NewReader(content)),
+		w:            &buf,
+		expectedSize: int64(len(content) + 1),
+		onClose:      func(complete bool) { gotComplete = complete },
+	}
+	if _, err := io.ReadAll(tee); err != nil {
+		t.Fatalf("reading: %v", err)
+	}
+	if err := tee.Close(); err != nil {
+		t.Fatalf("closing: %v", err)
+	}
+	if gotComplete {
+		t.Errorf("expected a stream whose length disagrees with the caller-supplied BlobInfo.Size to be reported incomplete")
+	}
+}
@@ -0,0 +1,74 @@
+package blobcache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tmpInfix names the scratch file a writer streams into before it's renamed into
+// place; it's distinguishable from finished cache entries so that directory scans (ClearCache,
+// Prune) can skip it even if a writer is killed mid-write, and HasBlob, which only looks up
+// exact digest file names, never sees it.
+const tmpInfix = ".tmp-"
+
+// cacheFileWriter streams a blob into a temporary file in the cache directory and only makes
+// it visible, via fsync followed by an atomic rename, once Commit is called; concurrent
+// writers to the same target file are serialized by a per-file lock (see lockPath) so that two
+// processes racing to cache the same blob can't interleave writes into a single file.
+type cacheFileWriter struct {
+	tmp    *os.File
+	target string
+	lock   *fileLock
+}
+
+// newCacheFileWriter blocks until it holds target's write lock, then opens a temporary file
+// next to it to stream into.
+func newCacheFileWriter(target string) (*cacheFileWriter, error) {
+	lock, err := lockPath(target)
+	if err != nil {
+		return nil, fmt.Errorf("locking %q: %w", target, err)
+	}
+	pattern := filepath.Base(target) + tmpInfix + fmt.Sprintf("%d-*", os.Getpid())
+	tmp, err := os.CreateTemp(filepath.Dir(target), pattern)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	return &cacheFileWriter{tmp: tmp, target: target, lock: lock}, nil
+}
+
+func (w *cacheFileWriter) Write(p []byte) (int, error) {
+	return w.tmp.Write(p)
+}
+
+// Commit fsyncs the temporary file and atomically renames it into place, then releases the
+// lock acquired by newCacheFileWriter.
+func (w *cacheFileWriter) Commit() error {
+	defer w.lock.Unlock()
+	if err := w.tmp.Sync(); err != nil {
+		w.tmp.Close()
+		os.Remove(w.tmp.Name())
+		return err
+	}
+	if err := w.tmp.Close(); err != nil {
+		os.Remove(w.tmp.Name())
+		return err
+	}
+	return os.Rename(w.tmp.Name(), w.target)
+}
+
+// Abandon discards the temporary file without making it visible, then releases the lock.
+func (w *cacheFileWriter) Abandon() error {
+	defer w.lock.Unlock()
+	w.tmp.Close()
+	return os.Remove(w.tmp.Name())
+}
+
+// isTempCacheFile reports whether name (a base name within a cache directory) is a
+// not-yet-committed scratch file, or a lock file, that callers scanning the directory should
+// ignore.
+func isTempCacheFile(name string) bool {
+	return filepath.Ext(name) == ".lock" || strings.Contains(name, tmpInfix)
+}
@@ -0,0 +1,101 @@
+package blobcache
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheFileWriterCommitRenamesIntoPlace(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "blob")
+	w, err := newCacheFileWriter(target)
+	if err != nil {
+		t.Fatalf("newCacheFileWriter: %v", err)
+	}
+	if _, err := w.Write([]byte("content")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	data, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatalf("reading committed file: %v", err)
+	}
+	if string(data) != "content" {
+		t.Errorf("committed file contains %q, want %q", data, "content")
+	}
+}
+
+func TestCacheFileWriterAbandonLeavesNoFinalFile(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "blob")
+	w, err := newCacheFileWriter(target)
+	if err != nil {
+		t.Fatalf("newCacheFileWriter: %v", err)
+	}
+	if _, err := w.Write([]byte("partial")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Abandon(); err != nil {
+		t.Fatalf("Abandon: %v", err)
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Errorf("expected no file at %q after Abandon, stat error: %v", target, err)
+	}
+}
+
+// TestConcurrentWritersToSameTargetDoNotInterleave is a regression test for the race the
+// destination and source write paths used to have: two writers racing to cache the same blob
+// digest must be serialized, not allowed to truncate or interleave each other's output.
+func TestConcurrentWritersToSameTargetDoNotInterleave(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "blob")
+	const n = 8
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w, err := newCacheFileWriter(target)
+			if err != nil {
+				t.Errorf("newCacheFileWriter: %v", err)
+				return
+			}
+			// Give other goroutines a chance to race in if locking were broken.
+			time.Sleep(time.Millisecond)
+			if _, err := w.Write([]byte("writer-content")); err != nil {
+				t.Errorf("Write: %v", err)
+				return
+			}
+			if err := w.Commit(); err != nil {
+				t.Errorf("Commit: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	data, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatalf("reading final file: %v", err)
+	}
+	if string(data) != "writer-content" {
+		t.Errorf("final file contains %q, want a single writer's untruncated, uninterleaved content %q", data, "writer-content")
+	}
+}
+
+func TestIsTempCacheFile(t *testing.T) {
+	cases := map[string]bool{
+		"sha256:abc":                false,
+		"sha256:abc.config":         false,
+		"sha256:abc.lock":           true,
+		"sha256:abc.tmp-123-xyz456": true,
+	}
+	for name, want := range cases {
+		if got := isTempCacheFile(name); got != want {
+			t.Errorf("isTempCacheFile(%q) = %v, want %v", name, got, want)
+		}
+	}
+}